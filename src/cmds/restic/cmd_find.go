@@ -1,10 +1,16 @@
 package main
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
+	"fmt"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -15,11 +21,24 @@ import (
 )
 
 var cmdFind = &cobra.Command{
-	Use:   "find [flags] PATTERN",
+	Use:   "find [flags] [PATTERN]",
 	Short: "find a file or directory",
 	Long: `
 The "find" command searches for files or directories in snapshots stored in the
-repo. `,
+repo.
+
+PATTERN is matched against the node name unless it contains a slash, in which
+case it is matched as a doublestar glob (supporting "**") against the full
+path. Use --regex to match the full path against a regular expression
+instead.
+
+PATTERN may be omitted if --blob, --pack, --size, --size-min or --size-max is
+given, in which case every node is considered a match for PATTERN and only
+the content-based filters apply.
+
+Use --json-stream to emit one JSON object per match as newline-delimited
+JSON (NDJSON), followed by a final summary object, instead of the single
+buffered JSON document produced by --json. `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return runFind(findOptions, globalOptions, args)
 	},
@@ -35,6 +54,19 @@ type FindOptions struct {
 	Host            string
 	Paths           []string
 	Tags            []string
+
+	BlobIDs []string
+	PackIDs []string
+	Size    string
+	SizeMin string
+	SizeMax string
+
+	Parallel int
+
+	Regex    bool
+	Excludes []string
+
+	JSONStream bool
 }
 
 var findOptions FindOptions
@@ -52,12 +84,398 @@ func init() {
 	f.StringVarP(&findOptions.Host, "host", "H", "", "only consider snapshots for this `host`, when no snapshot ID is given")
 	f.StringSliceVar(&findOptions.Tags, "tag", nil, "only consider snapshots which include this `tag`, when no snapshot-ID is given")
 	f.StringSliceVar(&findOptions.Paths, "path", nil, "only consider snapshots which include this (absolute) `path`, when no snapshot-ID is given")
+
+	f.StringSliceVar(&findOptions.BlobIDs, "blob", nil, "find files containing this `blob` (can be given multiple times)")
+	f.StringSliceVar(&findOptions.PackIDs, "pack", nil, "find files with blobs in this `pack` (can be given multiple times)")
+	f.StringVar(&findOptions.Size, "size", "", "find files with exactly this `size`, e.g. 1024 or 10MiB")
+	f.StringVar(&findOptions.SizeMin, "size-min", "", "find files with at least this `size`")
+	f.StringVar(&findOptions.SizeMax, "size-max", "", "find files with at most this `size`")
+
+	f.IntVar(&findOptions.Parallel, "parallel", 1, "number of snapshots to search in parallel, `n`")
+
+	f.BoolVar(&findOptions.Regex, "regex", false, "PATTERN is a regular expression matched against the full path")
+	f.StringSliceVar(&findOptions.Excludes, "exclude", nil, "`pattern` to exclude from the search, pruning whole subtrees when possible (a pattern without a slash matches at any depth; can be given multiple times)")
+
+	f.BoolVar(&findOptions.JSONStream, "json-stream", false, "output one JSON object per match as newline-delimited JSON, followed by a summary")
 }
 
 type findPattern struct {
 	oldest, newest time.Time
 	pattern        string
 	ignoreCase     bool
+	matchers       []matcher
+	prunes         []prunePredicate
+
+	// fingerprint identifies the combination of matchers and time range
+	// used by this search. It is part of the match-cache key so that
+	// results are never shared between differently configured searches.
+	fingerprint string
+}
+
+// prunePredicate reports whether a directory can be skipped entirely,
+// because nothing below it could possibly match. This lets findInTree avoid
+// descending into subtrees excluded by --exclude.
+type prunePredicate interface {
+	Prune(path string) bool
+}
+
+// excludeGlob prunes any path matched by a doublestar glob.
+type excludeGlob struct {
+	re *regexp.Regexp
+}
+
+func (e excludeGlob) Prune(path string) bool {
+	return e.re.MatchString(path)
+}
+
+// matcher is a predicate that can be applied to a node while walking a tree.
+// Several matchers are combined with AND semantics by matchAll. A matcher
+// that is able to name the blobs responsible for a match (e.g. --blob or
+// --pack) returns them so callers can report which blobs triggered the hit.
+type matcher interface {
+	Match(prefix string, node *restic.Node) (matched bool, blobs restic.IDs)
+}
+
+// matchAll combines several matchers with AND semantics.
+type matchAll []matcher
+
+func (m matchAll) Match(prefix string, node *restic.Node) (bool, restic.IDs) {
+	var blobs restic.IDs
+	for _, sub := range m {
+		ok, bs := sub.Match(prefix, node)
+		if !ok {
+			return false, nil
+		}
+		blobs = append(blobs, bs...)
+	}
+	return true, blobs
+}
+
+// nameMatcher matches the leaf name of a node against a shell glob pattern.
+type nameMatcher struct {
+	pattern    string
+	ignoreCase bool
+}
+
+func (m nameMatcher) Match(prefix string, node *restic.Node) (bool, restic.IDs) {
+	name := node.Name
+	if m.ignoreCase {
+		name = strings.ToLower(name)
+	}
+
+	ok, err := filepath.Match(m.pattern, name)
+	if err != nil {
+		debug.Log("invalid pattern %q: %v", m.pattern, err)
+		return false, nil
+	}
+	return ok, nil
+}
+
+// pathMatcher matches the accumulated prefix+name of a node against a
+// compiled regular expression. It backs both doublestar glob patterns
+// (e.g. "**/foo/*.log") and --regex.
+type pathMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m pathMatcher) Match(prefix string, node *restic.Node) (bool, restic.IDs) {
+	return m.re.MatchString(filepath.Join(prefix, node.Name)), nil
+}
+
+// newPatternMatcher builds the matcher for the PATTERN argument. A pattern
+// without a slash is matched against the node's name only, preserving the
+// historic behaviour; a pattern containing a slash is matched as a
+// doublestar glob against the full path.
+func newPatternMatcher(pattern string, ignoreCase, isRegex bool) (matcher, error) {
+	if isRegex {
+		re, err := compileMatcherRegexp(pattern, ignoreCase)
+		if err != nil {
+			return nil, errors.Fatalf("invalid --regex pattern: %v", err)
+		}
+		return pathMatcher{re: re}, nil
+	}
+
+	if !strings.Contains(pattern, "/") {
+		if ignoreCase {
+			pattern = strings.ToLower(pattern)
+		}
+		return nameMatcher{pattern: pattern, ignoreCase: ignoreCase}, nil
+	}
+
+	re, err := compileMatcherRegexp(doublestarToRegexpSrc(pattern), ignoreCase)
+	if err != nil {
+		return nil, errors.Fatalf("invalid pattern %q: %v", pattern, err)
+	}
+	return pathMatcher{re: re}, nil
+}
+
+// newExcludeMatcher builds a prune predicate for a single --exclude pattern.
+// A pattern containing a slash is anchored at the repository root, same as
+// doublestar patterns given as PATTERN. A pattern without a slash has no
+// notion of "root", so it is implicitly prefixed with "**/" and matches a
+// path component at any depth, e.g. --exclude node_modules excludes every
+// node_modules directory regardless of where it is nested.
+func newExcludeMatcher(pattern string) (prunePredicate, error) {
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	re, err := compileMatcherRegexp(doublestarToRegexpSrc(pattern), false)
+	if err != nil {
+		return nil, errors.Fatalf("invalid --exclude pattern %q: %v", pattern, err)
+	}
+	return excludeGlob{re: re}, nil
+}
+
+// compileMatcherRegexp compiles a regular expression, optionally folding it
+// to match case-insensitively.
+func compileMatcherRegexp(src string, ignoreCase bool) (*regexp.Regexp, error) {
+	if ignoreCase {
+		src = "(?i)" + src
+	}
+	return regexp.Compile(src)
+}
+
+// doublestarToRegexpSrc translates a doublestar glob (supporting "**" to
+// match any number of path elements) into the source of an equivalent
+// anchored regular expression. Glob character classes (e.g. "[abc]") are not
+// supported: "[" and "]" are escaped to match themselves literally, rather
+// than being passed through to RE2 where they could form an unbalanced or
+// misleading character class.
+func doublestarToRegexpSrc(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i += 2
+		case pattern[i] == '*':
+			sb.WriteString("[^/]*")
+			i++
+		case pattern[i] == '?':
+			sb.WriteString("[^/]")
+			i++
+		case strings.ContainsRune(`.+()|{}^$\[]`, rune(pattern[i])):
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			i++
+		default:
+			sb.WriteByte(pattern[i])
+			i++
+		}
+	}
+
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// blobMatcher matches files that reference at least one of a set of blobs.
+type blobMatcher struct {
+	blobs restic.IDSet
+}
+
+func (m blobMatcher) Match(prefix string, node *restic.Node) (bool, restic.IDs) {
+	if node.Type != "file" {
+		return false, nil
+	}
+
+	var found restic.IDs
+	for _, id := range node.Content {
+		if m.blobs.Has(id) {
+			found = append(found, id)
+		}
+	}
+	return len(found) > 0, found
+}
+
+// packMatcher matches files with at least one blob stored in one of a set
+// of packs.
+type packMatcher struct {
+	repo  restic.Repository
+	packs restic.IDSet
+}
+
+func (m packMatcher) Match(prefix string, node *restic.Node) (bool, restic.IDs) {
+	if node.Type != "file" {
+		return false, nil
+	}
+
+	var found restic.IDs
+	for _, id := range node.Content {
+		pbs, found2 := m.repo.Index().Lookup(id, restic.DataBlob)
+		if !found2 {
+			continue
+		}
+		for _, pb := range pbs {
+			if m.packs.Has(pb.PackID) {
+				found = append(found, id)
+				break
+			}
+		}
+	}
+	return len(found) > 0, found
+}
+
+// sizeMatcher matches files whose size falls within [min, max].
+type sizeMatcher struct {
+	min, max int64
+}
+
+func (m sizeMatcher) Match(prefix string, node *restic.Node) (bool, restic.IDs) {
+	if node.Type != "file" {
+		return false, nil
+	}
+
+	size := int64(node.Size)
+	if m.min >= 0 && size < m.min {
+		return false, nil
+	}
+	if m.max >= 0 && size > m.max {
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseSize parses a size given as a plain byte count or with a binary unit
+// suffix such as KiB, MiB or GiB.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"TiB", 1 << 40},
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+	}
+
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSuffix(s, u.suffix), 10, 64)
+			if err != nil {
+				return 0, errors.Fatalf("unable to parse size: %q", s)
+			}
+			return n * u.mul, nil
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.Fatalf("unable to parse size: %q", s)
+	}
+	return n, nil
+}
+
+// defaultTreeCacheSize is the number of trees kept in the repository-wide
+// tree cache. Trees are shared between all snapshots being searched, so a
+// tree referenced by many snapshots only needs to be loaded from the repo
+// once.
+const defaultTreeCacheSize = 4096
+
+// treeCache is a repository-wide, thread-safe LRU cache of loaded trees.
+type treeCache struct {
+	mu    sync.Mutex
+	cap   int
+	ll    *list.List
+	items map[restic.ID]*list.Element
+}
+
+type treeCacheEntry struct {
+	id   restic.ID
+	tree *restic.Tree
+}
+
+func newTreeCache(capacity int) *treeCache {
+	return &treeCache{
+		cap:   capacity,
+		ll:    list.New(),
+		items: make(map[restic.ID]*list.Element),
+	}
+}
+
+func (c *treeCache) get(id restic.ID) (*restic.Tree, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*treeCacheEntry).tree, true
+}
+
+func (c *treeCache) add(id restic.ID, tree *restic.Tree) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&treeCacheEntry{id: id, tree: tree})
+	c.items[id] = el
+
+	for c.ll.Len() > c.cap {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*treeCacheEntry).id)
+	}
+}
+
+// matchHit records a single matching node, found while walking a tree.
+// prefix is the directory the node was found in, relative to the snapshot
+// root, and does not include the node's own name.
+type matchHit struct {
+	prefix string
+	node   *restic.Node
+	blobs  restic.IDs
+}
+
+// matchCacheKey identifies the result of matching a tree's content against a
+// particular search. The same tree is frequently referenced by many
+// snapshots at the same path (e.g. directories that never change between
+// two snapshots of the same host), so results can be reused as long as the
+// search configuration (the fingerprint) is unchanged. Since --regex and
+// doublestar patterns match against the full path, the cache key has to
+// include the prefix the tree was found at, not just its ID.
+type matchCacheKey struct {
+	tree        restic.ID
+	prefix      string
+	fingerprint string
+}
+
+// matchCache stores, for every tree already visited, the list of matches
+// found within it (which may be empty). It replaces the old notfound set,
+// which could only remember a negative result.
+type matchCache struct {
+	mu sync.Mutex
+	m  map[matchCacheKey][]matchHit
+}
+
+func newMatchCache() *matchCache {
+	return &matchCache{m: make(map[matchCacheKey][]matchHit)}
+}
+
+func (c *matchCache) get(key matchCacheKey) ([]matchHit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hits, ok := c.m[key]
+	return hits, ok
+}
+
+func (c *matchCache) set(key matchCacheKey, hits []matchHit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = hits
 }
 
 var timeFormats = []string{
@@ -84,21 +502,91 @@ func parseTime(str string) (time.Time, error) {
 	return time.Time{}, errors.Fatalf("unable to parse time: %q", str)
 }
 
+// statefulOutput prints hits grouped by snapshot. Since snapshots may now be
+// searched concurrently, all printing goes through PrintGroup, which holds
+// mu for the whole group so that hits from different snapshots can never be
+// interleaved.
 type statefulOutput struct {
-	ListLong bool
-	JSON     bool
-	inuse    bool
-	newsn    *restic.Snapshot
-	oldsn    *restic.Snapshot
-	hits     int
+	ListLong   bool
+	JSON       bool
+	JSONStream bool
+
+	mu        sync.Mutex
+	inuse     bool
+	newsn     *restic.Snapshot
+	oldsn     *restic.Snapshot
+	hits      int
+	snapshots int
+}
+
+// PrintGroup prints all hits found in sn as a single, uninterrupted group.
+func (s *statefulOutput) PrintGroup(sn *restic.Snapshot, hits []matchHit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(hits) == 0 {
+		return
+	}
+
+	s.newsn = sn
+	s.snapshots++
+	for _, h := range hits {
+		if s.JSONStream {
+			s.printNDJSON(sn, h.prefix, h.node, h.blobs)
+		} else {
+			s.print(h.prefix, h.node, h.blobs)
+		}
+	}
+}
+
+// ndjsonMatch is the schema of a single line of --json-stream output.
+type ndjsonMatch struct {
+	SnapshotID   string     `json:"snapshot_id"`
+	SnapshotTime time.Time  `json:"snapshot_time"`
+	Host         string     `json:"host"`
+	Path         string     `json:"path"`
+	Size         uint64     `json:"size"`
+	Mode         string     `json:"mode"`
+	MTime        time.Time  `json:"mtime"`
+	Blobs        restic.IDs `json:"blobs,omitempty"`
+	Type         string     `json:"type"`
+}
+
+// ndjsonSummary is emitted once, after every match, by --json-stream.
+type ndjsonSummary struct {
+	MessageType string `json:"message_type"`
+	Hits        int    `json:"hits"`
+	Snapshots   int    `json:"snapshots"`
+}
+
+func (s *statefulOutput) printNDJSON(sn *restic.Snapshot, prefix string, node *restic.Node, blobs restic.IDs) {
+	b, err := json.Marshal(ndjsonMatch{
+		SnapshotID:   sn.ID().Str(),
+		SnapshotTime: sn.Time,
+		Host:         sn.Hostname,
+		Path:         filepath.Join(prefix, node.Name),
+		Size:         node.Size,
+		Mode:         node.Mode.String(),
+		MTime:        node.ModTime,
+		Blobs:        blobs,
+		Type:         node.Type,
+	})
+	if err != nil {
+		Warnf("Marshall failed: %v\n", err)
+		return
+	}
+
+	Printf("%s\n", b)
+	s.hits++
 }
 
-func (s *statefulOutput) PrintJSON(prefix string, node *restic.Node) {
+func (s *statefulOutput) PrintJSON(prefix string, node *restic.Node, blobs restic.IDs) {
 	type findNode restic.Node
 	b, err := json.Marshal(struct {
 		// Add these attributes
-		Path        string `json:"path,omitempty"`
-		Permissions string `json:"permissions,omitempty"`
+		Path        string     `json:"path,omitempty"`
+		Permissions string     `json:"permissions,omitempty"`
+		Blobs       restic.IDs `json:"blobs,omitempty"`
 
 		*findNode
 
@@ -112,6 +600,7 @@ func (s *statefulOutput) PrintJSON(prefix string, node *restic.Node) {
 	}{
 		Path:        filepath.Join(prefix, node.Name),
 		Permissions: node.Mode.String(),
+		Blobs:       blobs,
 		findNode:    (*findNode)(node),
 	})
 	if err != nil {
@@ -148,15 +637,26 @@ func (s *statefulOutput) PrintNormal(prefix string, node *restic.Node) {
 	Printf(formatNode(prefix, node, s.ListLong) + "\n")
 }
 
-func (s *statefulOutput) Print(prefix string, node *restic.Node) {
+// print writes a single hit. Callers must hold s.mu.
+func (s *statefulOutput) print(prefix string, node *restic.Node, blobs restic.IDs) {
 	if s.JSON {
-		s.PrintJSON(prefix, node)
+		s.PrintJSON(prefix, node, blobs)
 	} else {
 		s.PrintNormal(prefix, node)
 	}
 }
 
 func (s *statefulOutput) Finish() {
+	if s.JSONStream {
+		b, err := json.Marshal(ndjsonSummary{MessageType: "summary", Hits: s.hits, Snapshots: s.snapshots})
+		if err != nil {
+			Warnf("Marshall failed: %v\n", err)
+			return
+		}
+		Printf("%s\n", b)
+		return
+	}
+
 	if s.JSON {
 		// do some finishing up
 		if s.oldsn != nil {
@@ -171,93 +671,142 @@ func (s *statefulOutput) Finish() {
 	}
 }
 
-// Finder bundles information needed to find a file or directory.
+// Finder bundles information needed to find a file or directory. It is safe
+// for concurrent use by multiple goroutines, each searching a different
+// snapshot: trees and match results are shared through f.trees and
+// f.matches, and output is serialized by f.out.
 type Finder struct {
-	repo     restic.Repository
-	pat      findPattern
-	out      statefulOutput
-	notfound restic.IDSet
+	repo    restic.Repository
+	pat     findPattern
+	out     statefulOutput
+	trees   *treeCache
+	matches *matchCache
 }
 
-func (f *Finder) findInTree(treeID restic.ID, prefix string) error {
-	if f.notfound.Has(treeID) {
-		debug.Log("%v skipping tree %v, has already been checked", prefix, treeID.Str())
-		return nil
+// findInTree returns every match within treeID, mounted at prefix. Results
+// are cached per (tree, prefix, search), so that unchanged subtrees found at
+// the same path in successive snapshots are only loaded and matched once.
+// ctx is checked between nodes and passed to LoadTree, so that cancelling it
+// (e.g. because another snapshot's search already failed) stops an
+// in-progress traversal instead of letting it run to completion.
+func (f *Finder) findInTree(ctx context.Context, treeID restic.ID, prefix string) ([]matchHit, error) {
+	key := matchCacheKey{tree: treeID, prefix: prefix, fingerprint: f.pat.fingerprint}
+	if hits, ok := f.matches.get(key); ok {
+		debug.Log("cache hit for tree %v at %v\n", treeID.Str(), prefix)
+		return hits, nil
 	}
 
 	debug.Log("%v checking tree %v\n", prefix, treeID.Str())
 
-	tree, err := f.repo.LoadTree(context.TODO(), treeID)
-	if err != nil {
-		return err
+	tree, ok := f.trees.get(treeID)
+	if !ok {
+		var err error
+		tree, err = f.repo.LoadTree(ctx, treeID)
+		if err != nil {
+			return nil, err
+		}
+		f.trees.add(treeID, tree)
 	}
 
-	var found bool
+	var hits []matchHit
 	for _, node := range tree.Nodes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		debug.Log("  testing entry %q\n", node.Name)
 
-		name := node.Name
-		if f.pat.ignoreCase {
-			name = strings.ToLower(name)
-		}
+		path := filepath.Join(prefix, node.Name)
 
-		m, err := filepath.Match(f.pat.pattern, name)
-		if err != nil {
-			return err
+		if f.pruned(path) {
+			// --exclude applies to files and directories alike: a file is
+			// dropped from the results, a directory is additionally never
+			// recursed into.
+			debug.Log("    pruning %v, excluded\n", path)
+			continue
 		}
 
+		m, blobs := matchAll(f.pat.matchers).Match(prefix, node)
+
 		if m {
 			if !f.pat.oldest.IsZero() && node.ModTime.Before(f.pat.oldest) {
 				debug.Log("    ModTime is older than %s\n", f.pat.oldest)
-				continue
-			}
-
-			if !f.pat.newest.IsZero() && node.ModTime.After(f.pat.newest) {
+				m = false
+			} else if !f.pat.newest.IsZero() && node.ModTime.After(f.pat.newest) {
 				debug.Log("    ModTime is newer than %s\n", f.pat.newest)
-				continue
+				m = false
 			}
+		}
 
+		if m {
 			debug.Log("    found match\n")
-			found = true
-			f.out.Print(prefix, node)
+			hits = append(hits, matchHit{prefix: prefix, node: node, blobs: blobs})
 		}
 
 		if node.Type == "dir" {
-			if err := f.findInTree(*node.Subtree, filepath.Join(prefix, node.Name)); err != nil {
-				return err
+			sub, err := f.findInTree(ctx, *node.Subtree, path)
+			if err != nil {
+				return nil, err
 			}
+			hits = append(hits, sub...)
 		}
 	}
 
-	if !found {
-		f.notfound.Insert(treeID)
-	}
+	f.matches.set(key, hits)
+	return hits, nil
+}
 
-	return nil
+// pruned reports whether path is excluded by --exclude and its whole
+// subtree can be skipped.
+func (f *Finder) pruned(path string) bool {
+	for _, p := range f.pat.prunes {
+		if p.Prune(path) {
+			return true
+		}
+	}
+	return false
 }
 
-func (f *Finder) findInSnapshot(sn *restic.Snapshot) error {
+func (f *Finder) findInSnapshot(ctx context.Context, sn *restic.Snapshot) error {
 	debug.Log("searching in snapshot %s\n  for entries within [%s %s]", sn.ID(), f.pat.oldest, f.pat.newest)
 
-	f.out.newsn = sn
-	if err := f.findInTree(*sn.Tree, string(filepath.Separator)); err != nil {
+	hits, err := f.findInTree(ctx, *sn.Tree, string(filepath.Separator))
+	if err != nil {
 		return err
 	}
+	f.out.PrintGroup(sn, hits)
 	return nil
 }
 
 func runFind(opts FindOptions, gopts GlobalOptions, args []string) error {
-	if len(args) != 1 {
+	hasContentFilter := len(opts.BlobIDs) > 0 || len(opts.PackIDs) > 0 ||
+		opts.Size != "" || opts.SizeMin != "" || opts.SizeMax != ""
+
+	if len(args) > 1 || (len(args) == 0 && !hasContentFilter) {
 		return errors.Fatal("wrong number of arguments")
 	}
 
-	var err error
-	pat := findPattern{pattern: args[0]}
-	if opts.CaseInsensitive {
-		pat.pattern = strings.ToLower(pat.pattern)
-		pat.ignoreCase = true
+	if opts.JSONStream && globalOptions.JSON {
+		return errors.Fatal("--json-stream and --json are mutually exclusive")
+	}
+
+	if opts.Size != "" && (opts.SizeMin != "" || opts.SizeMax != "") {
+		return errors.Fatal("--size and --size-min/--size-max are mutually exclusive")
 	}
 
+	// PATTERN defaults to matching everything, so --blob/--pack/--size* can
+	// be used on their own to search by content instead of by name.
+	pattern := "*"
+	if opts.Regex {
+		pattern = ""
+	}
+	if len(args) == 1 {
+		pattern = args[0]
+	}
+
+	var err error
+	pat := findPattern{pattern: pattern, ignoreCase: opts.CaseInsensitive}
+
 	if opts.Oldest != "" {
 		if pat.oldest, err = parseTime(opts.Oldest); err != nil {
 			return err
@@ -287,21 +836,118 @@ func runFind(opts FindOptions, gopts GlobalOptions, args []string) error {
 		return err
 	}
 
+	patMatcher, err := newPatternMatcher(pat.pattern, pat.ignoreCase, opts.Regex)
+	if err != nil {
+		return err
+	}
+	pat.matchers = append(pat.matchers, patMatcher)
+
+	for _, ex := range opts.Excludes {
+		prune, err := newExcludeMatcher(ex)
+		if err != nil {
+			return err
+		}
+		pat.prunes = append(pat.prunes, prune)
+	}
+
+	if len(opts.BlobIDs) > 0 {
+		blobs := restic.NewIDSet()
+		for _, s := range opts.BlobIDs {
+			id, err := restic.ParseID(s)
+			if err != nil {
+				return errors.Fatalf("invalid id %q for --blob: %v", s, err)
+			}
+			blobs.Insert(id)
+		}
+		pat.matchers = append(pat.matchers, blobMatcher{blobs: blobs})
+	}
+
+	if len(opts.PackIDs) > 0 {
+		packs := restic.NewIDSet()
+		for _, s := range opts.PackIDs {
+			id, err := restic.ParseID(s)
+			if err != nil {
+				return errors.Fatalf("invalid id %q for --pack: %v", s, err)
+			}
+			packs.Insert(id)
+		}
+		pat.matchers = append(pat.matchers, packMatcher{repo: repo, packs: packs})
+	}
+
+	if opts.Size != "" {
+		size, err := parseSize(opts.Size)
+		if err != nil {
+			return err
+		}
+		pat.matchers = append(pat.matchers, sizeMatcher{min: size, max: size})
+	} else if opts.SizeMin != "" || opts.SizeMax != "" {
+		min, max := int64(-1), int64(-1)
+		if opts.SizeMin != "" {
+			if min, err = parseSize(opts.SizeMin); err != nil {
+				return err
+			}
+		}
+		if opts.SizeMax != "" {
+			if max, err = parseSize(opts.SizeMax); err != nil {
+				return err
+			}
+		}
+		pat.matchers = append(pat.matchers, sizeMatcher{min: min, max: max})
+	}
+
+	blobFP := append([]string(nil), opts.BlobIDs...)
+	sort.Strings(blobFP)
+	packFP := append([]string(nil), opts.PackIDs...)
+	sort.Strings(packFP)
+	excludeFP := append([]string(nil), opts.Excludes...)
+	sort.Strings(excludeFP)
+	pat.fingerprint = fmt.Sprintf("%s\x00%v\x00%v\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s",
+		pat.pattern, pat.ignoreCase, opts.Regex, opts.Oldest, opts.Newest,
+		strings.Join(blobFP, ","), strings.Join(packFP, ","),
+		opts.Size, opts.SizeMin, opts.SizeMax, strings.Join(excludeFP, ","))
+
 	ctx, cancel := context.WithCancel(gopts.ctx)
 	defer cancel()
 
 	f := &Finder{
-		repo:     repo,
-		pat:      pat,
-		out:      statefulOutput{ListLong: opts.ListLong, JSON: globalOptions.JSON},
-		notfound: restic.NewIDSet(),
+		repo:    repo,
+		pat:     pat,
+		out:     statefulOutput{ListLong: opts.ListLong, JSON: globalOptions.JSON, JSONStream: opts.JSONStream},
+		trees:   newTreeCache(defaultTreeCacheSize),
+		matches: newMatchCache(),
+	}
+
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
 	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, parallel)
+		firstMu sync.Mutex
+		first   error
+	)
 	for sn := range FindFilteredSnapshots(ctx, repo, opts.Host, opts.Tags, opts.Paths, opts.Snapshots) {
-		if err = f.findInSnapshot(sn); err != nil {
-			return err
-		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(sn *restic.Snapshot) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := f.findInSnapshot(ctx, sn); err != nil {
+				firstMu.Lock()
+				if first == nil {
+					first = err
+					cancel()
+				}
+				firstMu.Unlock()
+			}
+		}(sn)
 	}
+	wg.Wait()
+
 	f.out.Finish()
 
-	return nil
+	return first
 }
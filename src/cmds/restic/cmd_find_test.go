@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	var tests = []struct {
+		input   string
+		size    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"1KiB", 1 << 10, false},
+		{"10MiB", 10 * (1 << 20), false},
+		{"2GiB", 2 * (1 << 30), false},
+		{"3TiB", 3 * (1 << 40), false},
+		{"  42  ", 42, false},
+		{"", 0, true},
+		{"abc", 0, true},
+		{"10XiB", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			size, err := parseSize(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseSize(%q): expected error, got size %d", test.input, size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSize(%q): unexpected error: %v", test.input, err)
+			}
+			if size != test.size {
+				t.Fatalf("parseSize(%q): want %d, got %d", test.input, test.size, size)
+			}
+		})
+	}
+}
+
+func TestDoublestarToRegexpSrc(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		src     string
+	}{
+		{"foo", "^foo$"},
+		{"**/foo", "^(?:.*/)?foo$"},
+		{"foo/**", "^foo/.*$"},
+		{"a*b", "^a[^/]*b$"},
+		{"a?b", "^a[^/]b$"},
+		{"a.b", `^a\.b$`},
+		{"a[b]", `^a\[b\]$`},
+		{"a(b)", `^a\(b\)$`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			src := doublestarToRegexpSrc(test.pattern)
+			if src != test.src {
+				t.Fatalf("doublestarToRegexpSrc(%q): want %q, got %q", test.pattern, test.src, src)
+			}
+		})
+	}
+}
+
+func TestDoublestarToRegexpSrcUnbalancedBracket(t *testing.T) {
+	re, err := compileMatcherRegexp(doublestarToRegexpSrc("a[b"), false)
+	if err != nil {
+		t.Fatalf("unexpected error compiling escaped bracket pattern: %v", err)
+	}
+	if !re.MatchString("a[b") {
+		t.Fatalf("expected %q to match literal path %q", re.String(), "a[b")
+	}
+}
+
+func TestNewExcludeMatcherAnchoring(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		matches []string
+		misses  []string
+	}{
+		{
+			pattern: "node_modules",
+			matches: []string{"/node_modules", "/src/node_modules", "/a/b/node_modules"},
+			misses:  []string{"/node_modules_old", "/src/other"},
+		},
+		{
+			pattern: "*.log",
+			matches: []string{"/a.log", "/var/log/a.log"},
+			misses:  []string{"/a.log.gz"},
+		},
+		{
+			pattern: "/etc/**/*.conf",
+			matches: []string{"/etc/foo.conf", "/etc/sub/foo.conf"},
+			misses:  []string{"/tmp/etc/foo.conf"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			prune, err := newExcludeMatcher(test.pattern)
+			if err != nil {
+				t.Fatalf("newExcludeMatcher(%q): unexpected error: %v", test.pattern, err)
+			}
+			for _, path := range test.matches {
+				if !prune.Prune(path) {
+					t.Errorf("newExcludeMatcher(%q): expected %q to be pruned", test.pattern, path)
+				}
+			}
+			for _, path := range test.misses {
+				if prune.Prune(path) {
+					t.Errorf("newExcludeMatcher(%q): expected %q not to be pruned", test.pattern, path)
+				}
+			}
+		})
+	}
+}